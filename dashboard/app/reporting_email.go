@@ -7,10 +7,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/mail"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/google/syzkaller/dashboard/dashapi"
 	"github.com/google/syzkaller/pkg/email"
@@ -34,16 +36,99 @@ func init() {
 			}
 		}
 	}
+	initMailerConfig()
+}
+
+// initMailerConfig wires up the process-global Mailer/From/HMAC secret from
+// whichever EmailConfig sets them. These are process-wide, not per-namespace,
+// so at most one EmailConfig may set each of SMTPHost/From/SecretFile:
+// config.Namespaces is a map, and silently letting two conflicting configs
+// race for "who wins" would depend on its randomized iteration order.
+func initMailerConfig() {
+	var smtpSource, fromSource, secretSource string
+	for name, cfg := range config.Namespaces {
+		for _, reporting := range cfg.Reporting {
+			ecfg, ok := reporting.Config.(*EmailConfig)
+			if !ok {
+				continue
+			}
+			source := fmt.Sprintf("%v/%v", name, reporting.Name)
+			if ecfg.SMTPHost != "" {
+				if smtpSource != "" {
+					panic(fmt.Sprintf("conflicting SMTP mailer config in %v and %v", smtpSource, source))
+				}
+				smtpSource = source
+				mailer = email.NewSMTPMailer(email.SMTPConfig{
+					Host:     ecfg.SMTPHost,
+					Port:     ecfg.SMTPPort,
+					User:     ecfg.SMTPUser,
+					PassFile: ecfg.SMTPPassFile,
+					UseTLS:   ecfg.UseTLS,
+				})
+			}
+			if ecfg.From != "" {
+				if fromSource != "" {
+					panic(fmt.Sprintf("conflicting From override in %v and %v", fromSource, source))
+				}
+				fromSource = source
+				fromOverride = ecfg.From
+			}
+			if ecfg.SecretFile != "" {
+				if secretSource != "" {
+					panic(fmt.Sprintf("conflicting SecretFile in %v and %v", secretSource, source))
+				}
+				secretSource = source
+				key, err := ioutil.ReadFile(ecfg.SecretFile)
+				if err != nil {
+					panic(fmt.Sprintf("failed to read SecretFile for %v: %v", source, err))
+				}
+				email.SetSecret(key)
+			}
+		}
+	}
 }
 
 const emailType = "email"
 
 var mailingLists map[string]bool
 
+// mailer delivers outgoing mail. Defaults to the App Engine mail API, but
+// an EmailConfig with SMTPHost set switches it to SMTPMailer so that the
+// dashboard can be hosted off App Engine.
+var mailer email.Mailer = new(appengineMailer)
+
+// fromOverride, if set by an EmailConfig.From, replaces the App ID-derived
+// sender address for all outgoing mail.
+var fromOverride string
+
 type EmailConfig struct {
 	Email           string
 	Moderation      bool
 	MailMaintainers bool
+	// SMTPHost, if set, makes the dashboard send mail over SMTP instead of
+	// the App Engine mail API, which lets the dashboard run off App Engine.
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUser     string
+	SMTPPassFile string
+	// From overrides the App ID-derived sender address used for outgoing mail.
+	From   string
+	UseTLS bool
+	// SecretFile, if set, names a file holding the HMAC key used to sign
+	// reply tokens embedded in the From subaddress and in the
+	// Message-ID/References headers (see pkg/email/token.go). No separate
+	// Reply-To header is set.
+	SecretFile string
+	// Digest, if set, batches bug mail into a periodic summary instead of
+	// sending one email per bug/job (see reporting_email_digest.go). Mutually
+	// exclusive with the regular per-event mail this EmailConfig would
+	// otherwise send.
+	Digest       bool
+	DigestPeriod time.Duration
+	// CompressAttachmentsAbove gzips attachments (e.g. raw.log, config.txt)
+	// larger than this many bytes, to stay under mail transports' size
+	// limits. 0 disables compression.
+	CompressAttachmentsAbove int
 }
 
 func (cfg *EmailConfig) Type() string {
@@ -83,6 +168,11 @@ func handleEmailPoll(w http.ResponseWriter, r *http.Request) {
 func emailPollBugs(c context.Context) error {
 	reports := reportingPoll(c, emailType)
 	for _, rep := range reports {
+		// Digest-mode reportings are sent in bulk by emailPollDigests instead
+		// (an EmailConfig is either in per-event or digest mode, never both).
+		if isDigestReport(rep) {
+			continue
+		}
 		if err := emailReport(c, rep, "mail_bug.txt"); err != nil {
 			log.Errorf(c, "failed to report bug: %v", err)
 			continue
@@ -111,6 +201,9 @@ func emailPollJobs(c context.Context) error {
 		return err
 	}
 	for _, job := range jobs {
+		if isDigestReport(job) {
+			continue
+		}
 		if err := emailReport(c, job, "mail_test_result.txt"); err != nil {
 			log.Errorf(c, "failed to report job: %v", err)
 			continue
@@ -133,37 +226,46 @@ func emailReport(c context.Context, rep *dashapi.BugReport, templ string) error
 		to = append(to, rep.Maintainers...)
 	}
 	to = email.MergeEmailLists(to, rep.CC)
-	attachments := []aemail.Attachment{
+	attachments := []email.Attachment{
 		{
 			Name: "config.txt",
 			Data: rep.KernelConfig,
 		},
 	}
 	if len(rep.Patch) != 0 {
-		attachments = append(attachments, aemail.Attachment{
+		attachments = append(attachments, email.Attachment{
 			Name: "patch.txt",
 			Data: rep.Patch,
 		})
 	}
 	if len(rep.Log) != 0 {
-		attachments = append(attachments, aemail.Attachment{
+		attachments = append(attachments, email.Attachment{
 			Name: "raw.log",
 			Data: rep.Log,
 		})
 	}
 	if len(rep.ReproSyz) != 0 {
-		attachments = append(attachments, aemail.Attachment{
+		attachments = append(attachments, email.Attachment{
 			Name: "repro.txt",
 			Data: rep.ReproSyz,
 		})
 	}
 	if len(rep.ReproC) != 0 {
-		attachments = append(attachments, aemail.Attachment{
+		attachments = append(attachments, email.Attachment{
 			Name: "repro.c",
 			Data: rep.ReproC,
 		})
 	}
-	from, err := email.AddAddrContext(fromAddr(c), rep.ID)
+	if cfg.CompressAttachmentsAbove > 0 {
+		for i, a := range attachments {
+			compressed, err := email.CompressAttachment(a, cfg.CompressAttachmentsAbove)
+			if err != nil {
+				return err
+			}
+			attachments[i] = compressed
+		}
+	}
+	from, msgID, err := tokenFromAddr(c, rep.ID, cfg.Email, "report")
 	if err != nil {
 		return err
 	}
@@ -199,7 +301,7 @@ func emailReport(c context.Context, rep *dashapi.BugReport, templ string) error
 		ReproC:       len(rep.ReproC) != 0,
 	}
 	log.Infof(c, "sending email %q to %q", rep.Title, to)
-	err = sendMailTemplate(c, rep.Title, from, to, rep.ExtID, attachments, templ, data)
+	err = sendMailTemplate(c, rep.Title, from, msgID, to, rep.ExtID, attachments, templ, data)
 	if err != nil {
 		return err
 	}
@@ -285,56 +387,131 @@ func incomingMail(c context.Context, r *http.Request) error {
 
 var mailTemplates = template.Must(template.New("").ParseGlob("mail_*.txt"))
 
-func sendMailTemplate(c context.Context, subject, from string, to []string, replyTo string,
-	attachments []aemail.Attachment, template string, data interface{}) error {
+func sendMailTemplate(c context.Context, subject, from, msgID string, to []string, replyTo string,
+	attachments []email.Attachment, template string, data interface{}) error {
 	body := new(bytes.Buffer)
 	if err := mailTemplates.ExecuteTemplate(body, template, data); err != nil {
 		return fmt.Errorf("failed to execute %v template: %v", template, err)
 	}
-	msg := &aemail.Message{
+	msg := &email.Message{
 		Sender:      from,
 		To:          to,
 		Subject:     subject,
 		Body:        body.String(),
 		Attachments: attachments,
 	}
-	if replyTo != "" {
-		msg.Headers = mail.Header{"In-Reply-To": []string{replyTo}}
-	}
+	msg.Headers = tokenHeaders(msgID, replyTo)
 	return sendEmail(c, msg)
 }
 
-func replyTo(c context.Context, msg *email.Email, reply string, attachment *aemail.Attachment) error {
-	var attachments []aemail.Attachment
+func replyTo(c context.Context, msg *email.Email, reply string, attachment *email.Attachment) error {
+	var attachments []email.Attachment
 	if attachment != nil {
 		attachments = append(attachments, *attachment)
 	}
-	from, err := email.AddAddrContext(fromAddr(c), msg.BugID)
+	from, msgID, err := tokenFromAddr(c, msg.BugID, msg.From, "reply")
 	if err != nil {
 		return err
 	}
 	log.Infof(c, "sending reply: to=%q cc=%q subject=%q reply=%q",
 		msg.From, msg.Cc, msg.Subject, reply)
-	replyMsg := &aemail.Message{
+	replyMsg := &email.Message{
 		Sender:      from,
 		To:          []string{msg.From},
 		Cc:          msg.Cc,
 		Subject:     msg.Subject,
-		Body:        email.FormReply(msg.Body, reply),
+		Body:        email.FormReply(msg.NewText, reply),
 		Attachments: attachments,
-		Headers:     mail.Header{"In-Reply-To": []string{msg.MessageID}},
+		Headers:     tokenHeaders(msgID, msg.MessageID),
 	}
 	return sendEmail(c, replyMsg)
 }
 
+// tokenFromAddr builds a From address for a message about bugID, embedding
+// a signed token (see pkg/email/token.go) that msgID also carries in the
+// Message-ID/References headers, so that a reply can be tied back to the
+// bug without trusting the From address it arrives on.
+func tokenFromAddr(c context.Context, bugID, recipient, purpose string) (from, msgID string, err error) {
+	tok, tokErr := email.GenerateToken(email.Token{
+		BugID:     bugID,
+		Recipient: recipient,
+		Purpose:   purpose,
+	})
+	if tokErr != nil {
+		// No secret configured (e.g. local dev); fall back to the legacy
+		// unsigned encoding rather than failing to send mail.
+		from, err = email.AddAddrContext(fromAddr(c), bugID)
+		return from, "", err
+	}
+	from, err = email.AddAddrContext(fromAddr(c), tok)
+	if err != nil {
+		return "", "", err
+	}
+	// A Message-ID needs a domain; use our own, which is what email.Parse
+	// matches references against.
+	at := strings.LastIndex(from, "@")
+	return from, tok + strings.TrimSuffix(from[at:], ">"), nil
+}
+
+// tokenHeaders builds the References/Message-ID/In-Reply-To headers for an
+// outgoing message: msgID, if non-empty, is our own signed token to embed
+// as Message-ID so later replies can be tied back to the bug; inReplyTo is
+// the id of the message we're replying to, if any.
+func tokenHeaders(msgID, inReplyTo string) map[string][]string {
+	headers := make(map[string][]string)
+	if msgID != "" {
+		headers["Message-ID"] = []string{"<" + msgID + ">"}
+		headers["References"] = []string{"<" + msgID + ">"}
+	}
+	if inReplyTo != "" {
+		headers["In-Reply-To"] = []string{"<" + inReplyTo + ">"}
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
 // Sends email, can be stubbed for testing.
-var sendEmail = func(c context.Context, msg *aemail.Message) error {
-	if err := aemail.Send(c, msg); err != nil {
+var sendEmail = func(c context.Context, msg *email.Message) error {
+	if err := mailer.Send(c, msg); err != nil {
 		return fmt.Errorf("failed to send email: %v", err)
 	}
 	return nil
 }
 
+// appengineMailer is the default Mailer, delivering mail through the App
+// Engine mail API. It's the only Mailer implementation that depends on
+// App Engine, so that the rest of the dashboard can run without it.
+type appengineMailer struct{}
+
+func (appengineMailer) Send(c context.Context, msg *email.Message) error {
+	aeMsg := &aemail.Message{
+		Sender:  msg.Sender,
+		To:      msg.To,
+		Cc:      msg.Cc,
+		Subject: msg.Subject,
+		Body:    msg.Body,
+	}
+	if len(msg.Headers) != 0 {
+		hdr := make(mail.Header)
+		for k, v := range msg.Headers {
+			hdr[k] = v
+		}
+		aeMsg.Headers = hdr
+	}
+	for _, a := range msg.Attachments {
+		aeMsg.Attachments = append(aeMsg.Attachments, aemail.Attachment{
+			Name: a.Name,
+			Data: a.Data,
+		})
+	}
+	return aemail.Send(c, aeMsg)
+}
+
 func fromAddr(c context.Context) string {
+	if fromOverride != "" {
+		return fromOverride
+	}
 	return fmt.Sprintf("\"syzbot\" <bot@%v.appspotmail.com>", appengine.AppID(c))
 }
@@ -0,0 +1,312 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package dash
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+func init() {
+	http.HandleFunc("/email_digest", handleEmailDigest)
+}
+
+// handleEmailDigest is called by cron (less often than /email_poll) and
+// sends one summary email per namespace/reporting that's in digest mode,
+// instead of the usual one email per bug.
+func handleEmailDigest(w http.ResponseWriter, r *http.Request) {
+	c := appengine.NewContext(r)
+	if err := emailPollDigests(c); err != nil {
+		log.Errorf(c, "digest poll failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write([]byte("OK"))
+}
+
+// defaultDigestPeriod is used when an EmailConfig sets Digest but leaves
+// DigestPeriod unset.
+const defaultDigestPeriod = 24 * time.Hour
+
+// emailDigestState tracks, per namespace/reporting, the last time a digest
+// was sent, so that windows don't overlap across cron invocations.
+type emailDigestState struct {
+	LastSent time.Time
+	// PendingReproIDs is the ids of bugs that were included in a previous
+	// digest's "new bugs" section without a reproducer at the time. Kept
+	// around so a later digest can notice one of them getting a repro and
+	// call it out, instead of that ever becoming visible only as a silent
+	// state change.
+	PendingReproIDs []string
+}
+
+func emailPollDigests(c context.Context) error {
+	for ns, nsCfg := range config.Namespaces {
+		for _, reporting := range nsCfg.Reporting {
+			cfg, ok := reporting.Config.(*EmailConfig)
+			if !ok || !cfg.Digest {
+				continue
+			}
+			if err := emailSendDigest(c, ns, reporting.Name, cfg); err != nil {
+				log.Errorf(c, "digest for %v/%v failed: %v", ns, reporting.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func emailSendDigest(c context.Context, ns, reportingName string, cfg *EmailConfig) error {
+	key := datastore.NewKey(c, "EmailDigestState", ns+"|"+reportingName, 0, nil)
+	state := new(emailDigestState)
+	if err := datastore.Get(c, key, state); err != nil && err != datastore.ErrNoSuchEntity {
+		return fmt.Errorf("failed to load digest state: %v", err)
+	}
+	period := cfg.DigestPeriod
+	if period == 0 {
+		period = defaultDigestPeriod
+	}
+	now := time.Now()
+	if !state.LastSent.IsZero() && now.Sub(state.LastSent) < period {
+		return nil
+	}
+	bugs, jobs := collectDigestItems(c, ns, cfg)
+	closed, err := collectClosedBugs(c, ns, cfg)
+	if err != nil {
+		log.Errorf(c, "failed to poll closed bugs for digest: %v", err)
+	}
+	newRepros, stillPending, err := collectReproUpdates(c, state.PendingReproIDs, closed)
+	if err != nil {
+		log.Errorf(c, "failed to poll repro updates for digest: %v", err)
+		stillPending = state.PendingReproIDs
+	}
+	for _, rep := range bugs {
+		if len(rep.ReproC) == 0 && len(rep.ReproSyz) == 0 {
+			stillPending = append(stillPending, rep.ID)
+		}
+	}
+	if len(bugs) != 0 || len(jobs) != 0 || len(closed) != 0 || len(newRepros) != 0 {
+		if err := sendDigestMail(c, cfg, ns, period, bugs, closed, newRepros, jobs); err != nil {
+			return err
+		}
+		for _, rep := range bugs {
+			if err := ackDigestedBug(c, rep); err != nil {
+				log.Errorf(c, "failed to ack digested bug %v: %v", rep.ID, err)
+			}
+		}
+		for _, job := range jobs {
+			if err := jobReported(c, job.JobID); err != nil {
+				log.Errorf(c, "failed to mark digested job %v reported: %v", job.JobID, err)
+			}
+		}
+		for _, rep := range closed {
+			if err := closedBugDigested(c, rep.ID); err != nil {
+				log.Errorf(c, "failed to mark closed bug %v digested: %v", rep.ID, err)
+			}
+		}
+	}
+	state.LastSent = now
+	state.PendingReproIDs = stillPending
+	if _, err := datastore.Put(c, key, state); err != nil {
+		return fmt.Errorf("failed to save digest state: %v", err)
+	}
+	return nil
+}
+
+// collectDigestItems pulls the same pending reports/jobs the per-event path
+// (emailPollBugs/emailPollJobs) would otherwise have mailed individually,
+// restricted to the namespace/EmailConfig this digest covers.
+func collectDigestItems(c context.Context, ns string, cfg *EmailConfig) ([]*dashapi.BugReport, []*dashapi.BugReport) {
+	var bugs, jobs []*dashapi.BugReport
+	for _, rep := range reportingPoll(c, emailType) {
+		if rep.Namespace == ns && sameEmailConfig(rep, cfg) {
+			bugs = append(bugs, rep)
+		}
+	}
+	completed, err := pollCompletedJobs(c, emailType)
+	if err != nil {
+		log.Errorf(c, "failed to poll completed jobs for digest: %v", err)
+		return bugs, jobs
+	}
+	for _, job := range completed {
+		if job.Namespace == ns && sameEmailConfig(job, cfg) {
+			jobs = append(jobs, job)
+		}
+	}
+	return bugs, jobs
+}
+
+// collectClosedBugs returns bugs that transitioned to a terminal status
+// (fixed/invalid/dup) since they were last reported, so the digest can call
+// them out instead of dropping the notification on the floor. Each
+// returned report's Status is one of dashapi.BugStatusFixed/Invalid/Dup.
+func collectClosedBugs(c context.Context, ns string, cfg *EmailConfig) ([]*dashapi.BugReport, error) {
+	all, err := reportingPollClosed(c, emailType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to poll closed bugs: %v", err)
+	}
+	var closed []*dashapi.BugReport
+	for _, rep := range all {
+		if rep.Namespace == ns && sameEmailConfig(rep, cfg) {
+			closed = append(closed, rep)
+		}
+	}
+	return closed, nil
+}
+
+// collectReproUpdates checks pendingIDs (bug ids digested earlier without a
+// repro) for ones that have since acquired one, returning those as
+// newRepros and the remainder (minus anything in closed, which no longer
+// needs tracking) as stillPending.
+func collectReproUpdates(c context.Context, pendingIDs []string, closed []*dashapi.BugReport) (
+	newRepros []*dashapi.BugReport, stillPending []string, err error) {
+	if len(pendingIDs) == 0 {
+		return nil, nil, nil
+	}
+	closedIDs := make(map[string]bool)
+	for _, rep := range closed {
+		closedIDs[rep.ID] = true
+	}
+	withRepro, err := reportingBugsWithRepro(c, pendingIDs)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check repro updates: %v", err)
+	}
+	haveRepro := make(map[string]bool)
+	for _, rep := range withRepro {
+		haveRepro[rep.ID] = true
+	}
+	newRepros = withRepro
+	for _, id := range pendingIDs {
+		if !haveRepro[id] && !closedIDs[id] {
+			stillPending = append(stillPending, id)
+		}
+	}
+	return newRepros, stillPending, nil
+}
+
+func isDigestReport(rep *dashapi.BugReport) bool {
+	cfg := new(EmailConfig)
+	if err := json.Unmarshal(rep.Config, cfg); err != nil {
+		return false
+	}
+	return cfg.Digest
+}
+
+func sameEmailConfig(rep *dashapi.BugReport, cfg *EmailConfig) bool {
+	repCfg := new(EmailConfig)
+	if err := json.Unmarshal(rep.Config, repCfg); err != nil {
+		return false
+	}
+	return repCfg.Digest && repCfg.Email == cfg.Email
+}
+
+func ackDigestedBug(c context.Context, rep *dashapi.BugReport) error {
+	cmd := &dashapi.BugUpdate{
+		ID:         rep.ID,
+		Status:     dashapi.BugStatusOpen,
+		ReproLevel: dashapi.ReproLevelNone,
+	}
+	if len(rep.ReproC) != 0 {
+		cmd.ReproLevel = dashapi.ReproLevelC
+	} else if len(rep.ReproSyz) != 0 {
+		cmd.ReproLevel = dashapi.ReproLevelSyz
+	}
+	ok, reason, err := incomingCommand(c, cmd)
+	if !ok || err != nil {
+		return fmt.Errorf("ok=%v reason=%v err=%v", ok, reason, err)
+	}
+	return nil
+}
+
+// closedBugDigested marks a closed bug as having been included in a digest,
+// the same way jobReported does for completed jobs, so reportingPollClosed
+// doesn't hand it back on the next poll.
+func closedBugDigested(c context.Context, id string) error {
+	return bugClosureReported(c, id)
+}
+
+// digestBugData and digestJobData are the per-item rows rendered by
+// mail_digest.txt.
+type digestBugData struct {
+	Title string
+	Link  string
+}
+
+type digestJobData struct {
+	Title string
+	Link  string
+}
+
+type digestData struct {
+	Namespace string
+	Period    string
+	// Bugs is reported bugs that don't yet have a reproducer.
+	Bugs []digestBugData
+	// Repros is reported bugs that came in with a reproducer already
+	// attached, broken out separately since a repro is the more
+	// actionable event.
+	Repros []digestBugData
+	// NewRepros is bugs that were digested earlier without a reproducer
+	// and have since acquired one.
+	NewRepros []digestBugData
+	// Fixed, Invalid and Dup are bugs that closed with that status since
+	// they were last reported.
+	Fixed   []digestBugData
+	Invalid []digestBugData
+	Dup     []digestBugData
+	Jobs    []digestJobData
+}
+
+func sendDigestMail(c context.Context, cfg *EmailConfig, ns string, period time.Duration,
+	bugs, closed, newRepros, jobs []*dashapi.BugReport) error {
+	data := &digestData{
+		Namespace: ns,
+		Period:    period.String(),
+	}
+	for _, rep := range bugs {
+		row := digestBugData{Title: rep.Title, Link: digestBugLink(c, rep.ID)}
+		if len(rep.ReproC) != 0 || len(rep.ReproSyz) != 0 {
+			data.Repros = append(data.Repros, row)
+		} else {
+			data.Bugs = append(data.Bugs, row)
+		}
+	}
+	for _, rep := range newRepros {
+		data.NewRepros = append(data.NewRepros, digestBugData{Title: rep.Title, Link: digestBugLink(c, rep.ID)})
+	}
+	for _, rep := range closed {
+		row := digestBugData{Title: rep.Title, Link: digestBugLink(c, rep.ID)}
+		switch rep.Status {
+		case dashapi.BugStatusFixed:
+			data.Fixed = append(data.Fixed, row)
+		case dashapi.BugStatusInvalid:
+			data.Invalid = append(data.Invalid, row)
+		case dashapi.BugStatusDup:
+			data.Dup = append(data.Dup, row)
+		default:
+			log.Errorf(c, "digest: closed bug %v has unexpected status %v, dropping from digest", rep.ID, rep.Status)
+		}
+	}
+	for _, job := range jobs {
+		data.Jobs = append(data.Jobs, digestJobData{Title: job.Title, Link: digestBugLink(c, job.ID)})
+	}
+	subject := fmt.Sprintf("%v digest: %v bug(s), %v closed, %v job(s)", ns, len(bugs), len(closed), len(data.Jobs))
+	from, msgID, err := tokenFromAddr(c, "", cfg.Email, "digest")
+	if err != nil {
+		return err
+	}
+	log.Infof(c, "sending digest %q to %q", subject, cfg.Email)
+	return sendMailTemplate(c, subject, from, msgID, []string{cfg.Email}, "", nil, "mail_digest.txt", data)
+}
+
+func digestBugLink(c context.Context, id string) string {
+	return fmt.Sprintf("https://%v.appspot.com/bug?id=%v", appengine.AppID(c), id)
+}
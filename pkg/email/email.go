@@ -0,0 +1,310 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package email parses/formats email messages for the bug tracker bot.
+package email
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+)
+
+// Email is a parsed incoming message, reduced to what the dashboard needs
+// to turn it into a dashapi.BugUpdate.
+type Email struct {
+	BugID     string
+	MessageID string
+	Link      string
+	Subject   string
+	From      string
+	Cc        []string
+	Body      string
+	// NewText is Body with quoted ancestry and any signature block
+	// stripped, i.e. only what the sender actually typed in this reply.
+	NewText     string
+	Patch       []byte
+	Command     string
+	CommandArgs string
+}
+
+var (
+	linkRe    = regexp.MustCompile(`(https?://\S+)`)
+	commandRe = regexp.MustCompile(`(?m)^#syz\s+(\S+)(?:[ \t]+(.*))?$`)
+)
+
+// Parse extracts an Email from a raw RFC822 message r. ownEmail is the
+// dashboard's own address, used to recognize which headers/addresses can
+// encode the bug ID.
+func Parse(r io.Reader, ownEmail string) (*Email, error) {
+	msg, err := mail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse email: %v", err)
+	}
+	email := &Email{
+		Subject:   msg.Header.Get("Subject"),
+		MessageID: strings.Trim(msg.Header.Get("Message-ID"), "<>"),
+	}
+	if from, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		email.From = from.Address
+	} else {
+		email.From = msg.Header.Get("From")
+	}
+	if cc, err := msg.Header.AddressList("Cc"); err == nil {
+		for _, addr := range cc {
+			email.Cc = append(email.Cc, addr.Address)
+		}
+	}
+	body, patch, err := parseBody(msg)
+	if err != nil {
+		return nil, err
+	}
+	email.Body = body
+	email.Patch = patch
+	email.NewText = SplitQuoted(body)
+	if link := linkRe.FindString(body); link != "" {
+		email.Link = link
+	}
+	if m := commandRe.FindStringSubmatch(email.NewText); m != nil {
+		email.Command = m[1]
+		email.CommandArgs = strings.TrimSpace(m[2])
+	}
+	bugID, err := recoverBugID(msg.Header, ownEmail)
+	if err != nil {
+		return nil, err
+	}
+	email.BugID = bugID
+	return email, nil
+}
+
+// parseBody returns the text/plain body and, if present, a patch attachment.
+func parseBody(msg *mail.Message) (string, []byte, error) {
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		body, err := decodeBody(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+		return body, nil, err
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var body string
+	var patch []byte
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to parse multipart body: %v", err)
+		}
+		data, err := decodeBody(part, part.Header.Get("Content-Transfer-Encoding"))
+		if err != nil {
+			return "", nil, err
+		}
+		disp := part.Header.Get("Content-Disposition")
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		switch {
+		case strings.Contains(disp, "attachment") && strings.Contains(strings.ToLower(part.FileName()), "patch"):
+			patch = []byte(data)
+		case body == "" && partType == "text/plain" && !strings.Contains(disp, "attachment"):
+			body = data
+		}
+	}
+	return body, patch, nil
+}
+
+func decodeBody(r io.Reader, encoding string) (string, error) {
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read email body: %v", err)
+	}
+	return string(data), nil
+}
+
+// recoverBugID figures out which bug the message is about, by recovering
+// and verifying the signed token (see token.go) embedded either in
+// References/In-Reply-To/Message-ID or in the To/From subaddress. A
+// message that carries something token-shaped which fails verification is
+// rejected outright: forging the From address or mangling the subaddress
+// must not let an attacker target an arbitrary bug. A message that carries
+// no token at all (e.g. unrelated mail) simply yields no bug ID.
+//
+// If no signing secret is configured (HasSecret), this deployment never
+// minted signed tokens in the first place, so there's nothing to verify:
+// References/In-Reply-To/Message-ID are ignored and the subaddress is
+// trusted as-is, matching the unsigned scheme tokenFromAddr falls back to
+// on the send side. Configuring a secret is what turns on verification.
+func recoverBugID(h mail.Header, ownEmail string) (string, error) {
+	ownAddr := ownEmail
+	if addr, err := mail.ParseAddress(ownEmail); err == nil {
+		ownAddr = addr.Address
+	}
+	ownDomain := ownAddr[strings.LastIndex(ownAddr, "@")+1:]
+	if HasSecret() {
+		for _, header := range []string{"In-Reply-To", "References", "Message-ID"} {
+			for _, ref := range extractMsgIDs(h.Get(header)) {
+				tok, ok := tokenFromRef(ref, ownDomain)
+				if !ok {
+					continue
+				}
+				t, err := ParseToken(tok)
+				if err != nil {
+					return "", fmt.Errorf("email: rejecting message with invalid token: %v", err)
+				}
+				return t.BugID, nil
+			}
+		}
+	}
+	for _, addr := range []string{h.Get("To"), h.Get("From")} {
+		bugID, hasToken, err := bugIDFromLocalPart(addr, ownAddr)
+		if err != nil {
+			return "", err
+		}
+		if hasToken {
+			return bugID, nil
+		}
+	}
+	return "", nil
+}
+
+var msgIDRe = regexp.MustCompile(`<([^<>\s]+)>`)
+
+func extractMsgIDs(header string) []string {
+	var ids []string
+	for _, m := range msgIDRe.FindAllStringSubmatch(header, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+// tokenFromRef extracts a syzbot-minted token from a Message-ID-shaped
+// reference on ownDomain, e.g. "<token@bot.syzkaller.appspotmail.com>" ->
+// "token". References on any other domain are not ours and are skipped.
+func tokenFromRef(ref, ownDomain string) (string, bool) {
+	at := strings.LastIndex(ref, "@")
+	if at == -1 || !strings.EqualFold(ref[at+1:], ownDomain) {
+		return "", false
+	}
+	local := ref[:at]
+	local = strings.TrimPrefix(local, "bot+")
+	if !strings.Contains(local, ".") {
+		// Our tokens always contain a "." separating payload and signature.
+		return "", false
+	}
+	return local, true
+}
+
+// bugIDFromLocalPart extracts and verifies a signed token embedded in
+// addr's subaddress (e.g. "bot+<token>@domain"), if addr is our own address
+// ownAddr. hasToken reports whether such a subaddress was present at all,
+// so the caller can tell "no token here"
+// (try the next candidate) from "a token was present but invalid", which
+// is returned as an error instead of being silently ignored.
+//
+// Without a signing secret configured, the subaddress is the legacy
+// unsigned bug id (see recoverBugID) rather than a token, so it's trusted
+// directly.
+func bugIDFromLocalPart(addr, ownAddr string) (bugID string, hasToken bool, err error) {
+	parsed, perr := mail.ParseAddress(addr)
+	if perr != nil {
+		return "", false, nil
+	}
+	base, id, rerr := RemoveAddrContext(parsed.Address)
+	if rerr != nil || id == "" || !strings.EqualFold(base, ownAddr) {
+		return "", false, nil
+	}
+	if !HasSecret() {
+		return id, true, nil
+	}
+	t, terr := ParseToken(id)
+	if terr != nil {
+		return "", true, fmt.Errorf("email: rejecting message with invalid token in %q: %v", addr, terr)
+	}
+	return t.BugID, true, nil
+}
+
+// AddAddrContext encodes id into the local part of email as a subaddress,
+// e.g. "bot@d.com" + "123" -> "<bot+123@d.com>".
+func AddAddrContext(email, id string) (string, error) {
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse %q as email address: %v", email, err)
+	}
+	at := strings.LastIndex(addr.Address, "@")
+	if at == -1 {
+		return "", fmt.Errorf("failed to parse %q as email address", email)
+	}
+	addr.Address = addr.Address[:at] + "+" + id + addr.Address[at:]
+	return addr.String(), nil
+}
+
+// RemoveAddrContext splits a subaddressed email into the plain address and
+// the context id encoded by AddAddrContext, if any.
+func RemoveAddrContext(email string) (string, string, error) {
+	at := strings.LastIndex(email, "@")
+	if at == -1 {
+		return "", "", fmt.Errorf("failed to parse %q as email address", email)
+	}
+	local, domain := email[:at], email[at:]
+	plus := strings.Index(local, "+")
+	if plus == -1 {
+		return email, "", nil
+	}
+	return local[:plus] + domain, local[plus+1:], nil
+}
+
+// CanonicalEmail lower-cases email and strips any +subaddress, so that
+// "User+foo@Domain.com" and "user@domain.com" compare equal.
+func CanonicalEmail(email string) string {
+	email = strings.ToLower(email)
+	at := strings.LastIndex(email, "@")
+	if at == -1 {
+		return email
+	}
+	local, domain := email[:at], email[at:]
+	if plus := strings.Index(local, "+"); plus != -1 {
+		local = local[:plus]
+	}
+	return local + domain
+}
+
+// MergeEmailLists merges several email lists, de-duping by CanonicalEmail
+// while preserving first-seen casing/subaddress.
+func MergeEmailLists(lists ...[]string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, list := range lists {
+		for _, addr := range list {
+			canon := CanonicalEmail(addr)
+			if canon == "" || seen[canon] {
+				continue
+			}
+			seen[canon] = true
+			merged = append(merged, addr)
+		}
+	}
+	return merged
+}
+
+// FormReply quotes body and prepends reply to it, for use as the body of a
+// reply email.
+func FormReply(body, reply string) string {
+	lines := strings.Split(strings.TrimRight(body, "\n"), "\n")
+	quoted := make([]string, len(lines))
+	for i, line := range lines {
+		quoted[i] = "> " + line
+	}
+	return reply + "\n\nOn the original report:\n" + strings.Join(quoted, "\n") + "\n"
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package email
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRejectsForgedBugID(t *testing.T) {
+	SetSecret([]byte("test-secret"))
+	defer SetSecret(nil)
+
+	// No References/In-Reply-To at all: just a forged To address trying to
+	// smuggle an arbitrary bug ID in via the subaddress, the way the old
+	// From-local-part encoding used to allow.
+	raw := "From: attacker@example.com\r\n" +
+		"To: bot+some-other-users-bug-id@example.com\r\n" +
+		"Subject: Re: bug\r\n" +
+		"\r\n" +
+		"#syz invalid\r\n"
+	_, err := Parse(strings.NewReader(raw), "bot@example.com")
+	if err == nil {
+		t.Fatal("expected Parse to reject a forged/unsigned bug id, got nil error")
+	}
+}
+
+func TestParseAcceptsVerifiedToken(t *testing.T) {
+	SetSecret([]byte("test-secret"))
+	defer SetSecret(nil)
+
+	tok, err := GenerateToken(Token{BugID: "bug123", Recipient: "user@example.com", Purpose: "report"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := AddAddrContext("bot@example.com", tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := "From: user@example.com\r\n" +
+		"To: " + addr + "\r\n" +
+		"Subject: Re: bug\r\n" +
+		"\r\n" +
+		"#syz invalid\r\n"
+	msg, err := Parse(strings.NewReader(raw), "bot@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.BugID != "bug123" {
+		t.Fatalf("got bug id %q, want bug123", msg.BugID)
+	}
+}
+
+func TestParseTrustsUnsignedBugIDWithoutSecret(t *testing.T) {
+	// No secret configured: this deployment never minted signed tokens,
+	// so the subaddress must still be accepted as the legacy unsigned bug
+	// id instead of every reply becoming unparseable.
+	SetSecret(nil)
+
+	raw := "From: user@example.com\r\n" +
+		"To: bot+bug123@example.com\r\n" +
+		"Subject: Re: bug\r\n" +
+		"\r\n" +
+		"#syz invalid\r\n"
+	msg, err := Parse(strings.NewReader(raw), "bot@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.BugID != "bug123" {
+		t.Fatalf("got bug id %q, want bug123", msg.BugID)
+	}
+}
+
+func TestParseNoTokenYieldsNoBugID(t *testing.T) {
+	SetSecret([]byte("test-secret"))
+	defer SetSecret(nil)
+
+	raw := "From: user@example.com\r\n" +
+		"To: bot@example.com\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"just saying hi\r\n"
+	msg, err := Parse(strings.NewReader(raw), "bot@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.BugID != "" {
+		t.Fatalf("got bug id %q, want none", msg.BugID)
+	}
+}
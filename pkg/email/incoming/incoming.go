@@ -0,0 +1,296 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package incoming implements an IMAP-based poller that feeds incoming bug
+// reply emails into the dashboard, as an alternative to App Engine's
+// /_ah/mail/ webhook. It lets syzbot's mail reporting run against a mailbox
+// hosted anywhere, not just App Engine.
+package incoming
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	idleext "github.com/emersion/go-imap-idle"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+	"github.com/google/syzkaller/pkg/email"
+)
+
+// Config describes how to reach the IMAP server that receives bug replies.
+type Config struct {
+	Host     string
+	Port     int
+	UseTLS   bool // implicit TLS (port 993)
+	StartTLS bool // STARTTLS on a plaintext connection
+	User     string
+	PassFile string
+	// Mailbox is polled for new messages, defaults to INBOX.
+	Mailbox string
+	// ProcessedMailbox is where handled messages are moved to, if set.
+	ProcessedMailbox string
+	// StateFile persists the last-seen UIDVALIDITY/UID between runs in a
+	// flat JSON file. Ignored if BoltStateFile is set.
+	StateFile string
+	// BoltStateFile persists the last-seen UIDVALIDITY/UID in a local
+	// BoltDB database instead, for operators who'd rather have a single
+	// embedded key-value store than a bespoke file format. Takes
+	// precedence over StateFile if both are set.
+	BoltStateFile string
+	// PollInterval is used when the server doesn't support IDLE.
+	PollInterval time.Duration
+	// OwnEmail is passed to email.Parse to recognize our own address.
+	OwnEmail string
+}
+
+// Handler processes a single incoming command, the same way
+// dash.incomingCommand does for the App Engine webhook.
+type Handler func(ctx context.Context, cmd *dashapi.BugUpdate) (ok bool, reason string, err error)
+
+// RunIncomingLoop connects to cfg's IMAP server and feeds new messages to
+// handle until ctx is cancelled. A failed poll is logged and retried after
+// cfg.PollInterval; only a failure to open the state store ends the loop
+// early.
+func RunIncomingLoop(ctx context.Context, cfg Config, handle Handler) error {
+	if cfg.Mailbox == "" {
+		cfg.Mailbox = "INBOX"
+	}
+	if cfg.PollInterval == 0 {
+		cfg.PollInterval = time.Minute
+	}
+	store, err := newState(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to open state store: %v", err)
+	}
+	if closer, ok := store.(interface{ Close() error }); ok {
+		defer closer.Close()
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := pollOnce(ctx, cfg, handle, store); err != nil {
+			log.Printf("incoming: poll failed, will retry: %v", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(cfg.PollInterval):
+			}
+		}
+	}
+}
+
+func pollOnce(ctx context.Context, cfg Config, handle Handler, store stateStore) error {
+	c, err := dial(cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+	mbox, err := c.Select(cfg.Mailbox, false)
+	if err != nil {
+		return fmt.Errorf("failed to select %v: %v", cfg.Mailbox, err)
+	}
+	lastUIDValidity, lastUID := store.Get()
+	if mbox.UidValidity != lastUIDValidity {
+		// The mailbox was recreated, UIDs are no longer comparable, start over.
+		lastUID = 0
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fetchAndDispatch(ctx, c, cfg, store, mbox.UidValidity, &lastUID, handle); err != nil {
+			return err
+		}
+		if err := idleOrSleep(c, cfg); err != nil {
+			return err
+		}
+	}
+}
+
+// fetchAndDispatch fetches all messages with UID > *lastUID and hands them
+// to the existing email.Parse/Handler pipeline, moving handled messages to
+// the processed mailbox and advancing *lastUID as it goes.
+func fetchAndDispatch(ctx context.Context, c *client.Client, cfg Config, store stateStore,
+	uidValidity uint32, lastUID *uint32, handle Handler) error {
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(*lastUID+1, 0)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return fmt.Errorf("uid search failed: %v", err)
+	}
+	for _, uid := range uids {
+		if uid <= *lastUID {
+			continue
+		}
+		body, err := fetchRaw(c, uid)
+		if err != nil {
+			// Transient fetch error, requeue by not advancing lastUID past it.
+			return fmt.Errorf("failed to fetch uid %v: %v", uid, err)
+		}
+		msg, err := email.Parse(bytes.NewReader(body), cfg.OwnEmail)
+		if err != nil {
+			log.Printf("incoming: failed to parse uid %v, skipping: %v", uid, err)
+		} else if err := dispatch(ctx, msg, handle); err != nil {
+			return fmt.Errorf("failed to dispatch uid %v: %v", uid, err)
+		}
+		if cfg.ProcessedMailbox != "" {
+			if err := moveToProcessed(c, uid, cfg.ProcessedMailbox); err != nil {
+				log.Printf("incoming: failed to move uid %v to %v: %v", uid, cfg.ProcessedMailbox, err)
+			}
+		}
+		*lastUID = uid
+		if err := store.Set(uidValidity, uid); err != nil {
+			log.Printf("incoming: failed to persist state: %v", err)
+		}
+	}
+	return nil
+}
+
+// dispatch hands a parsed message to the same BugUpdate path used for the
+// App Engine webhook: it maps the #syz command the same way
+// dash.incomingMail's switch does, since that logic lives in an
+// App Engine-bound package this standalone poller can't import.
+func dispatch(ctx context.Context, msg *email.Email, handle Handler) error {
+	cmd := &dashapi.BugUpdate{
+		ID:    msg.BugID,
+		ExtID: msg.MessageID,
+		Link:  msg.Link,
+		CC:    msg.Cc,
+	}
+	switch msg.Command {
+	case "":
+		cmd.Status = dashapi.BugStatusUpdate
+	case "upstream":
+		cmd.Status = dashapi.BugStatusUpstream
+	case "invalid":
+		cmd.Status = dashapi.BugStatusInvalid
+	case "fix:":
+		if msg.CommandArgs == "" {
+			log.Printf("incoming: #syz fix: with no commit title, ignoring")
+			return nil
+		}
+		cmd.Status = dashapi.BugStatusOpen
+		cmd.FixCommits = []string{msg.CommandArgs}
+	case "dup:":
+		if msg.CommandArgs == "" {
+			log.Printf("incoming: #syz dup: with no dup title, ignoring")
+			return nil
+		}
+		cmd.Status = dashapi.BugStatusDup
+		cmd.DupOf = msg.CommandArgs
+	case "test:":
+		// Kicking off a test job needs the same infrastructure as the App
+		// Engine webhook's handleTestRequest, which this standalone poller
+		// doesn't have; ignore rather than silently misapplying a status.
+		log.Printf("incoming: #syz test: is not supported over the IMAP poller, ignoring")
+		return nil
+	default:
+		log.Printf("incoming: unknown command %q, ignoring", msg.Command)
+		return nil
+	}
+	_, _, err := handle(ctx, cmd)
+	return err
+}
+
+func fetchRaw(c *client.Client, uid uint32) ([]byte, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	section := &imap.BodySectionName{}
+	items := []imap.FetchItem{section.FetchItem()}
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, items, messages)
+	}()
+	msg := <-messages
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, fmt.Errorf("message not found")
+	}
+	lit := msg.GetBody(section)
+	if lit == nil {
+		return nil, fmt.Errorf("empty body")
+	}
+	return ioutil.ReadAll(lit)
+}
+
+func moveToProcessed(c *client.Client, uid uint32, mailbox string) error {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uid)
+	return c.UidMove(seqSet, mailbox)
+}
+
+// idleOrSleep waits for new mail using IMAP IDLE, falling back to a plain
+// sleep for servers that don't advertise the IDLE capability.
+func idleOrSleep(c *client.Client, cfg Config) error {
+	supportsIdle, err := c.Support("IDLE")
+	if err != nil {
+		return err
+	}
+	if !supportsIdle {
+		time.Sleep(cfg.PollInterval)
+		return nil
+	}
+	return idleFor(c, cfg.PollInterval)
+}
+
+// idleFor blocks until the server reports mailbox activity or timeout
+// elapses, using the IMAP IDLE extension (RFC 2177).
+func idleFor(c *client.Client, timeout time.Duration) error {
+	idleClient := idleext.NewClient(c)
+	updates := make(chan client.Update, 1)
+	c.Updates = updates
+	defer func() { c.Updates = nil }()
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- idleClient.IdleWithFallback(stop, timeout)
+	}()
+	select {
+	case <-updates:
+		close(stop)
+		<-done
+		return nil
+	case err := <-done:
+		return err
+	}
+}
+
+func dial(cfg Config) (*client.Client, error) {
+	addr := fmt.Sprintf("%v:%v", cfg.Host, cfg.Port)
+	var c *client.Client
+	var err error
+	if cfg.UseTLS {
+		c, err = client.DialTLS(addr, nil)
+	} else {
+		c, err = client.Dial(addr)
+		if err == nil && cfg.StartTLS {
+			err = c.StartTLS(&tls.Config{ServerName: cfg.Host})
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %v: %v", addr, err)
+	}
+	pass, err := ioutil.ReadFile(cfg.PassFile)
+	if err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("failed to read pass file %v: %v", cfg.PassFile, err)
+	}
+	if err := c.Login(cfg.User, strings.TrimSpace(string(pass))); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("imap login failed: %v", err)
+	}
+	return c, nil
+}
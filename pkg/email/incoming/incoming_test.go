@@ -0,0 +1,119 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/syzkaller/dashboard/dashapi"
+	"github.com/google/syzkaller/pkg/email"
+)
+
+// TestDispatchMapsCommands pins dispatch's #syz command -> BugUpdate.Status
+// mapping to dash.incomingMail's switch, so the two can't silently drift
+// apart again the way they did once already in this series.
+func TestDispatchMapsCommands(t *testing.T) {
+	tests := []struct {
+		name       string
+		msg        *email.Email
+		wantCalled bool
+		wantStatus dashapi.BugStatus
+		wantFix    []string
+		wantDupOf  string
+	}{
+		{
+			name:       "empty command is a plain update",
+			msg:        &email.Email{BugID: "bug1"},
+			wantCalled: true,
+			wantStatus: dashapi.BugStatusUpdate,
+		},
+		{
+			name:       "upstream",
+			msg:        &email.Email{BugID: "bug1", Command: "upstream"},
+			wantCalled: true,
+			wantStatus: dashapi.BugStatusUpstream,
+		},
+		{
+			name:       "invalid",
+			msg:        &email.Email{BugID: "bug1", Command: "invalid"},
+			wantCalled: true,
+			wantStatus: dashapi.BugStatusInvalid,
+		},
+		{
+			name:       "fix with commit title",
+			msg:        &email.Email{BugID: "bug1", Command: "fix:", CommandArgs: "some commit title"},
+			wantCalled: true,
+			wantStatus: dashapi.BugStatusOpen,
+			wantFix:    []string{"some commit title"},
+		},
+		{
+			name: "fix with no commit title is ignored",
+			msg:  &email.Email{BugID: "bug1", Command: "fix:"},
+		},
+		{
+			name:       "dup with title",
+			msg:        &email.Email{BugID: "bug1", Command: "dup:", CommandArgs: "other bug title"},
+			wantCalled: true,
+			wantStatus: dashapi.BugStatusDup,
+			wantDupOf:  "other bug title",
+		},
+		{
+			name: "dup with no title is ignored",
+			msg:  &email.Email{BugID: "bug1", Command: "dup:"},
+		},
+		{
+			name: "test is not supported over IMAP",
+			msg:  &email.Email{BugID: "bug1", Command: "test:", CommandArgs: "linux"},
+		},
+		{
+			name: "unknown command is ignored",
+			msg:  &email.Email{BugID: "bug1", Command: "bogus"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var called bool
+			var got *dashapi.BugUpdate
+			handle := func(ctx context.Context, cmd *dashapi.BugUpdate) (bool, string, error) {
+				called = true
+				got = cmd
+				return true, "", nil
+			}
+			if err := dispatch(context.Background(), test.msg, handle); err != nil {
+				t.Fatal(err)
+			}
+			if called != test.wantCalled {
+				t.Fatalf("handle called = %v, want %v", called, test.wantCalled)
+			}
+			if !test.wantCalled {
+				return
+			}
+			if got.ID != test.msg.BugID {
+				t.Fatalf("got ID %v, want %v", got.ID, test.msg.BugID)
+			}
+			if got.Status != test.wantStatus {
+				t.Fatalf("got status %v, want %v", got.Status, test.wantStatus)
+			}
+			if test.wantFix != nil && !equalStrings(got.FixCommits, test.wantFix) {
+				t.Fatalf("got fix commits %v, want %v", got.FixCommits, test.wantFix)
+			}
+			if got.DupOf != test.wantDupOf {
+				t.Fatalf("got dup of %q, want %q", got.DupOf, test.wantDupOf)
+			}
+		})
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// stateStore persists the last-seen UIDVALIDITY/UID pair across restarts of
+// the poller. fileState (a small local JSON file) and boltState (a local
+// BoltDB database, see state_bolt.go) are the two implementations; newState
+// picks between them based on Config.
+type stateStore interface {
+	Get() (uidValidity, uid uint32)
+	Set(uidValidity, uid uint32) error
+}
+
+// newState picks a stateStore backend for cfg: BoltStateFile, if set,
+// takes precedence over StateFile.
+func newState(cfg Config) (stateStore, error) {
+	if cfg.BoltStateFile != "" {
+		return newBoltState(cfg.BoltStateFile)
+	}
+	return newFileState(cfg.StateFile)
+}
+
+// fileState is the plain-JSON-file stateStore: no extra dependencies,
+// fine for a single poller process.
+type fileState struct {
+	path string
+	mu   sync.Mutex
+	data stateData
+}
+
+type stateData struct {
+	UIDValidity uint32 `json:"uid_validity"`
+	UID         uint32 `json:"uid"`
+}
+
+func newFileState(path string) (*fileState, error) {
+	s := &fileState{path: path}
+	if path == "" {
+		return s, nil
+	}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &s.data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileState) Get() (uidValidity, uid uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.UIDValidity, s.data.UID
+}
+
+func (s *fileState) Set(uidValidity, uid uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = stateData{UIDValidity: uidValidity, UID: uid}
+	if s.path == "" {
+		return nil
+	}
+	buf, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(s.path, buf, 0o600)
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"encoding/json"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	stateBucket = []byte("incoming_state")
+	stateKey    = []byte("uid_state")
+)
+
+// boltState is the stateStore backed by a local BoltDB database, for
+// operators who'd rather point the poller at a single embedded key-value
+// store than a bespoke JSON file.
+type boltState struct {
+	db   *bolt.DB
+	mu   sync.Mutex
+	data stateData
+}
+
+func newBoltState(path string) (*boltState, error) {
+	db, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := &boltState{db: db}
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateBucket)
+		if b == nil {
+			return nil
+		}
+		buf := b.Get(stateKey)
+		if buf == nil {
+			return nil
+		}
+		return json.Unmarshal(buf, &s.data)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *boltState) Get() (uidValidity, uid uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.UIDValidity, s.data.UID
+}
+
+func (s *boltState) Set(uidValidity, uid uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = stateData{UIDValidity: uidValidity, UID: uid}
+	buf, err := json.Marshal(s.data)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(stateBucket)
+		if err != nil {
+			return err
+		}
+		return b.Put(stateKey, buf)
+	})
+}
+
+// Close releases the underlying BoltDB file handle.
+func (s *boltState) Close() error {
+	return s.db.Close()
+}
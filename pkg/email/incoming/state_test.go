@@ -0,0 +1,67 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package incoming
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStatePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := newFileState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validity, uid := s.Get(); validity != 0 || uid != 0 {
+		t.Fatalf("new state not empty: %v/%v", validity, uid)
+	}
+	if err := s.Set(42, 7); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := newFileState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validity, uid := s2.Get(); validity != 42 || uid != 7 {
+		t.Fatalf("state not persisted: %v/%v", validity, uid)
+	}
+}
+
+func TestBoltStatePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.bolt")
+	s, err := newBoltState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if validity, uid := s.Get(); validity != 0 || uid != 0 {
+		t.Fatalf("new state not empty: %v/%v", validity, uid)
+	}
+	if err := s.Set(42, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := newBoltState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if validity, uid := s2.Get(); validity != 42 || uid != 7 {
+		t.Fatalf("state not persisted: %v/%v", validity, uid)
+	}
+}
+
+func TestNewStatePicksBoltWhenConfigured(t *testing.T) {
+	cfg := Config{BoltStateFile: filepath.Join(t.TempDir(), "state.bolt")}
+	store, err := newState(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.(*boltState).Close()
+	if _, ok := store.(*boltState); !ok {
+		t.Fatalf("got %T, want *boltState", store)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Message is a transport-independent representation of an outgoing email,
+// used by Mailer implementations so that the rest of the dashboard does not
+// need to depend on App Engine's mail package.
+type Message struct {
+	Sender      string
+	To          []string
+	Cc          []string
+	Subject     string
+	Body        string
+	Headers     map[string][]string
+	Attachments []Attachment
+}
+
+// Attachment is a single file attached to a Message.
+type Attachment struct {
+	Name string
+	Data []byte
+	// Encoding, if set (e.g. "gzip"), is a hint for transports that can set
+	// a Content-Encoding header; transports that can't should still work
+	// since CompressAttachment also renames the attachment with a matching
+	// suffix (e.g. "raw.log" -> "raw.log.gz").
+	Encoding string
+}
+
+// CompressAttachment gzips a's data and renames it (e.g. "raw.log" to
+// "raw.log.gz") if it's larger than thresholdBytes, to stay under mail
+// transports' message size limits. Attachments at or below the threshold,
+// or when thresholdBytes <= 0, are returned unchanged.
+func CompressAttachment(a Attachment, thresholdBytes int) (Attachment, error) {
+	if thresholdBytes <= 0 || len(a.Data) <= thresholdBytes {
+		return a, nil
+	}
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	if _, err := gz.Write(a.Data); err != nil {
+		return Attachment{}, fmt.Errorf("failed to gzip attachment %v: %v", a.Name, err)
+	}
+	if err := gz.Close(); err != nil {
+		return Attachment{}, fmt.Errorf("failed to gzip attachment %v: %v", a.Name, err)
+	}
+	return Attachment{
+		Name:     a.Name + ".gz",
+		Data:     buf.Bytes(),
+		Encoding: "gzip",
+	}, nil
+}
+
+// Mailer sends an outgoing Message. Implementations may deliver the message
+// over SMTP, hand it to App Engine's mail API, log it for local testing, or
+// drop it entirely.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// LogMailer only logs outgoing messages. Useful for development and tests.
+type LogMailer struct{}
+
+func (LogMailer) Send(ctx context.Context, msg *Message) error {
+	log.Printf("email: from=%q to=%q cc=%q subject=%q (%v attachments)",
+		msg.Sender, msg.To, msg.Cc, msg.Subject, len(msg.Attachments))
+	return nil
+}
+
+// NullMailer drops all outgoing messages.
+type NullMailer struct{}
+
+func (NullMailer) Send(ctx context.Context, msg *Message) error {
+	return nil
+}
+
+// SMTPConfig describes how to reach an SMTP server and authenticate to it.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	User     string
+	PassFile string
+	UseTLS   bool
+}
+
+// SMTPMailer sends messages over SMTP, with optional PLAIN SASL auth (used
+// when Config.User is set); LOGIN auth is not supported.
+// It's meant for operators that host the dashboard off App Engine and want
+// to use their own mail relay.
+type SMTPMailer struct {
+	Config SMTPConfig
+}
+
+func NewSMTPMailer(cfg SMTPConfig) *SMTPMailer {
+	return &SMTPMailer{Config: cfg}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	addr := fmt.Sprintf("%v:%v", m.Config.Host, m.Config.Port)
+	body, err := buildMIME(msg)
+	if err != nil {
+		return fmt.Errorf("failed to build mime message: %v", err)
+	}
+	auth, err := m.auth()
+	if err != nil {
+		return err
+	}
+	rcpts := append(append([]string{}, msg.To...), msg.Cc...)
+	if m.Config.UseTLS {
+		return sendSMTPTLS(addr, auth, msg.Sender, rcpts, body)
+	}
+	return smtp.SendMail(addr, auth, msg.Sender, rcpts, body)
+}
+
+func (m *SMTPMailer) auth() (smtp.Auth, error) {
+	if m.Config.User == "" {
+		return nil, nil
+	}
+	pass, err := ioutil.ReadFile(m.Config.PassFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read smtp pass file %q: %v", m.Config.PassFile, err)
+	}
+	return smtp.PlainAuth("", m.Config.User, strings.TrimSpace(string(pass)), m.Config.Host), nil
+}
+
+func sendSMTPTLS(addr string, auth smtp.Auth, from string, to []string, body []byte) error {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: strings.Split(addr, ":")[0]})
+	if err != nil {
+		return fmt.Errorf("failed to dial smtp server: %v", err)
+	}
+	defer conn.Close()
+	host := strings.Split(addr, ":")[0]
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return fmt.Errorf("failed to create smtp client: %v", err)
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("smtp auth failed: %v", err)
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildMIME renders msg as a multipart/mixed RFC 2822 message with the
+// attachments as separate parts.
+func buildMIME(msg *Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "From: %v\r\n", msg.Sender)
+	fmt.Fprintf(buf, "To: %v\r\n", strings.Join(msg.To, ", "))
+	if len(msg.Cc) != 0 {
+		fmt.Fprintf(buf, "Cc: %v\r\n", strings.Join(msg.Cc, ", "))
+	}
+	fmt.Fprintf(buf, "Subject: %v\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	for name, values := range msg.Headers {
+		for _, v := range values {
+			fmt.Fprintf(buf, "%v: %v\r\n", name, v)
+		}
+	}
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+	body, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := body.Write([]byte(msg.Body)); err != nil {
+		return nil, err
+	}
+	for _, a := range msg.Attachments {
+		header := textproto.MIMEHeader{
+			"Content-Type":              {"application/octet-stream"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", a.Name)},
+			"Content-Transfer-Encoding": {"base64"},
+		}
+		if a.Encoding != "" {
+			header.Set("Content-Encoding", a.Encoding)
+		}
+		part, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(base64Lines(a.Data)); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// base64Lines base64-encodes data and wraps it at the 76-column limit
+// RFC 2045 specifies for Content-Transfer-Encoding: base64, since relays
+// are free to mangle lines longer than the 998-octet SMTP limit (gzipped
+// attachments in particular are binary and can easily contain raw NULs
+// and CRs that "Content-Transfer-Encoding: binary" would ship unescaped).
+func base64Lines(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for i := 0; i < len(encoded); i += 76 {
+		end := i + 76
+		if end > len(encoded) {
+			end = len(encoded)
+		}
+		buf.WriteString(encoded[i:end])
+		buf.WriteString("\r\n")
+	}
+	return buf.Bytes()
+}
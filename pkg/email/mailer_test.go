@@ -0,0 +1,76 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package email
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestCompressAttachmentSmallUnchanged(t *testing.T) {
+	a := Attachment{Name: "config.txt", Data: []byte("small")}
+	got, err := CompressAttachment(a, 64<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != a.Name || !bytes.Equal(got.Data, a.Data) || got.Encoding != "" {
+		t.Fatalf("small attachment was modified: %+v", got)
+	}
+}
+
+func TestBuildMIMEEncodesAttachmentsAsBase64(t *testing.T) {
+	msg := &Message{
+		Sender:  "bot@example.com",
+		To:      []string{"user@example.com"},
+		Subject: "test",
+		Body:    "body",
+		Attachments: []Attachment{
+			{Name: "repro.c", Data: []byte{0x00, 0x0d, 0x0a, 0xff, 'a', 'b', 'c'}},
+		},
+	}
+	out, err := buildMIME(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("Content-Transfer-Encoding: base64")) {
+		t.Fatalf("attachment part is not declared as base64:\n%s", out)
+	}
+	want := base64.StdEncoding.EncodeToString(msg.Attachments[0].Data)
+	if !bytes.Contains(out, []byte(want)) {
+		t.Fatalf("base64-encoded attachment body not found in message:\n%s", out)
+	}
+}
+
+func TestCompressAttachmentLargeRoundTrips(t *testing.T) {
+	data := []byte(strings.Repeat("a", 100<<10))
+	a := Attachment{Name: "raw.log", Data: data}
+	got, err := CompressAttachment(a, 64<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "raw.log.gz" {
+		t.Fatalf("got name %q, want raw.log.gz", got.Name)
+	}
+	if got.Encoding != "gzip" {
+		t.Fatalf("got encoding %q, want gzip", got.Encoding)
+	}
+	if len(got.Data) >= len(data) {
+		t.Fatalf("compressed data (%v bytes) not smaller than original (%v bytes)", len(got.Data), len(data))
+	}
+	r, err := gzip.NewReader(bytes.NewReader(got.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("decompressed data doesn't match original")
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package email
+
+import (
+	"regexp"
+	"strings"
+)
+
+// quoteHeaderRe matches the "On ... wrote:" line most MUAs (Gmail, Apple
+// Mail, Mutt) prepend to quoted ancestry. It's deliberately loose about the
+// middle of the line since MUAs format the date/name differently, and
+// covers a couple of common non-English variants (Forgejo's incoming
+// mailer has to deal with the same localized footers).
+var quoteHeaderRe = regexp.MustCompile(`(?i)^>*\s*(On .+ wrote:|Am .+ schrieb:|Le .+ a écrit\s*:)\s*$`)
+
+// outlookHeaderRe matches the separator Outlook inserts above a quoted
+// message when there's no "On ... wrote:" line.
+var outlookHeaderRe = regexp.MustCompile(`(?i)^-+\s*Original Message\s*-+$`)
+
+// outlookFieldRe matches the "From:"/"Sent:"/"To:"/"Subject:" header block
+// Outlook writes above quoted text instead of a single "On ... wrote:" line.
+var outlookFieldRe = regexp.MustCompile(`(?i)^(From|Sent|To|Subject):\s`)
+
+// sigRe matches the conventional "-- " signature delimiter (RFC off-the-cuff
+// convention, trailing space included) as well as a bare "--".
+var sigRe = regexp.MustCompile(`^--\s?$`)
+
+// quoteMarkerRe matches a line that's part of a ">"-quoted block.
+var quoteMarkerRe = regexp.MustCompile(`^\s*>`)
+
+// SplitQuoted returns the text the sender actually wrote, with quoted
+// ancestry (leading ">" blocks, "On ... wrote:"/Outlook-style headers) and
+// any trailing signature block removed. It's used both to decide which
+// part of a reply to scan for "#syz" commands, and to avoid re-quoting an
+// ever-growing blockquote in our own replies.
+func SplitQuoted(body string) string {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	end := len(lines)
+loop:
+	for i, line := range lines {
+		switch {
+		case quoteMarkerRe.MatchString(line):
+			end = i
+			break loop
+		case quoteHeaderRe.MatchString(line):
+			end = i
+			break loop
+		case outlookHeaderRe.MatchString(line):
+			end = i
+			break loop
+		case outlookFieldRe.MatchString(line) && startsOutlookHeaderBlock(lines[i:]):
+			end = i
+			break loop
+		case sigRe.MatchString(line):
+			end = i
+			break loop
+		}
+	}
+	return strings.TrimRight(strings.Join(lines[:end], "\n"), " \t\n")
+}
+
+// startsOutlookHeaderBlock reports whether lines begins a classic Outlook
+// "From:/Sent:/To:/Subject:" quoted-message header block (at least two of
+// the four fields present in the next few lines).
+func startsOutlookHeaderBlock(lines []string) bool {
+	matched := 0
+	for i := 0; i < len(lines) && i < 4; i++ {
+		if outlookFieldRe.MatchString(lines[i]) {
+			matched++
+		}
+	}
+	return matched >= 2
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package email
+
+import "testing"
+
+func TestSplitQuoted(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{
+			name: "gmail",
+			body: "#syz test: repo branch\n" +
+				"\n" +
+				"On Mon, Jan 1, 2024 at 1:23 PM Bob <bob@example.com> wrote:\n" +
+				"> old command that should not be re-executed\n" +
+				"> #syz fix: old commit\n",
+			want: "#syz test: repo branch",
+		},
+		{
+			name: "apple_mail",
+			body: "looks fixed now\n" +
+				"\n" +
+				"> On Jan 1, 2024, at 1:23 PM, Bob <bob@example.com> wrote:\n" +
+				">\n" +
+				"> #syz fix: old commit\n",
+			want: "looks fixed now",
+		},
+		{
+			name: "mutt",
+			body: "#syz invalid\n" +
+				"\n" +
+				"On 2024-01-01 13:23, Bob wrote:\n" +
+				"> #syz upstream\n",
+			want: "#syz invalid",
+		},
+		{
+			name: "outlook_original_message",
+			body: "#syz dup: other bug\n" +
+				"\n" +
+				"-----Original Message-----\n" +
+				"From: Bob <bob@example.com>\n" +
+				"Sent: Monday, January 1, 2024 1:23 PM\n" +
+				"To: syzbot\n" +
+				"Subject: Re: bug\n" +
+				"\n" +
+				"#syz fix: old commit\n",
+			want: "#syz dup: other bug",
+		},
+		{
+			name: "outlook_header_block_no_separator",
+			body: "no repro, closing\n" +
+				"\n" +
+				"From: Bob <bob@example.com>\n" +
+				"Sent: Monday, January 1, 2024 1:23 PM\n" +
+				"To: syzbot\n" +
+				"Subject: Re: bug\n" +
+				"\n" +
+				"#syz invalid\n",
+			want: "no repro, closing",
+		},
+		{
+			name: "signature",
+			body: "#syz fix: aaaaaaaaaaaa\n" +
+				"-- \n" +
+				"Sent from my phone\n",
+			want: "#syz fix: aaaaaaaaaaaa",
+		},
+		{
+			name: "plain_no_quoting",
+			body: "#syz upstream\n",
+			want: "#syz upstream",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := SplitQuoted(test.body)
+			if got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TokenTTL is how long a generated reply token remains valid. Replies
+// older than this are rejected even if the signature checks out.
+const TokenTTL = 30 * 24 * time.Hour
+
+// Token identifies what an outgoing message was about, so that a reply to
+// it can be trusted without relying on the (easily forged or mangled)
+// From/Reply-To local part.
+type Token struct {
+	BugID     string
+	Recipient string
+	Purpose   string
+	Time      time.Time
+}
+
+// secret is the HMAC key used to sign/verify tokens. EmailConfig wires it
+// up once at startup via SetSecret before any token is generated or parsed.
+var secret []byte
+
+// SetSecret installs the HMAC key used for token generation/verification.
+func SetSecret(key []byte) {
+	secret = key
+}
+
+// HasSecret reports whether a signing secret has been installed via
+// SetSecret. Callers use this to decide whether to require a verified
+// token or fall back to trusting an unsigned bug id, for deployments that
+// haven't configured one.
+func HasSecret() bool {
+	return len(secret) != 0
+}
+
+// GenerateToken produces an opaque, signed string embedding t, safe to hand
+// to an untrusted mail transport as part of a Reply-To/References header.
+func GenerateToken(t Token) (string, error) {
+	if len(secret) == 0 {
+		return "", fmt.Errorf("email: token secret is not configured")
+	}
+	if t.Time.IsZero() {
+		t.Time = time.Now()
+	}
+	payload := encodeTokenPayload(t)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return encodeSegment(payload) + "." + encodeSegment(mac.Sum(nil)), nil
+}
+
+// ParseToken recovers and verifies a token produced by GenerateToken,
+// rejecting it if the signature doesn't match or it has expired.
+func ParseToken(s string) (Token, error) {
+	if len(secret) == 0 {
+		return Token{}, fmt.Errorf("email: token secret is not configured")
+	}
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		return Token{}, fmt.Errorf("email: malformed token")
+	}
+	payload, err := decodeSegment(parts[0])
+	if err != nil {
+		return Token{}, fmt.Errorf("email: malformed token payload: %v", err)
+	}
+	sig, err := decodeSegment(parts[1])
+	if err != nil {
+		return Token{}, fmt.Errorf("email: malformed token signature: %v", err)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return Token{}, fmt.Errorf("email: token signature mismatch")
+	}
+	t, err := decodeTokenPayload(payload)
+	if err != nil {
+		return Token{}, err
+	}
+	if time.Since(t.Time) > TokenTTL {
+		return Token{}, fmt.Errorf("email: token expired")
+	}
+	return t, nil
+}
+
+func encodeSegment(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSegment(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func encodeTokenPayload(t Token) []byte {
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint64(ts, uint64(t.Time.Unix()))
+	fields := []string{
+		encodeSegment(ts),
+		encodeSegment([]byte(t.BugID)),
+		encodeSegment([]byte(t.Recipient)),
+		encodeSegment([]byte(t.Purpose)),
+	}
+	return []byte(strings.Join(fields, ","))
+}
+
+func decodeTokenPayload(payload []byte) (Token, error) {
+	fields := strings.Split(string(payload), ",")
+	if len(fields) != 4 {
+		return Token{}, fmt.Errorf("email: malformed token fields")
+	}
+	tsBytes, err := decodeSegment(fields[0])
+	if err != nil || len(tsBytes) != 8 {
+		return Token{}, fmt.Errorf("email: malformed token timestamp")
+	}
+	bugID, err := decodeSegment(fields[1])
+	if err != nil {
+		return Token{}, fmt.Errorf("email: malformed token bug id")
+	}
+	recipient, err := decodeSegment(fields[2])
+	if err != nil {
+		return Token{}, fmt.Errorf("email: malformed token recipient")
+	}
+	purpose, err := decodeSegment(fields[3])
+	if err != nil {
+		return Token{}, fmt.Errorf("email: malformed token purpose")
+	}
+	return Token{
+		BugID:     string(bugID),
+		Recipient: string(recipient),
+		Purpose:   string(purpose),
+		Time:      time.Unix(int64(binary.BigEndian.Uint64(tsBytes)), 0),
+	}, nil
+}
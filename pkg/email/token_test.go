@@ -0,0 +1,41 @@
+// Copyright 2017 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package email
+
+import "testing"
+
+func TestTokenRoundTrip(t *testing.T) {
+	SetSecret([]byte("test-secret"))
+	defer SetSecret(nil)
+
+	tok, err := GenerateToken(Token{BugID: "bug123", Recipient: "a@b.com", Purpose: "report"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseToken(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.BugID != "bug123" || got.Recipient != "a@b.com" || got.Purpose != "report" {
+		t.Fatalf("got %+v", got)
+	}
+}
+
+func TestTokenRejectsTampering(t *testing.T) {
+	SetSecret([]byte("test-secret"))
+	defer SetSecret(nil)
+
+	tok, err := GenerateToken(Token{BugID: "bug123"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseToken(tok + "x"); err == nil {
+		t.Fatal("expected tampered token to be rejected")
+	}
+
+	SetSecret([]byte("different-secret"))
+	if _, err := ParseToken(tok); err == nil {
+		t.Fatal("expected token signed with a different secret to be rejected")
+	}
+}